@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"appengine/datastore"
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// Codec marshals and unmarshals an Entity for storage as a memcache value.
+type Codec interface {
+	Marshal(e *Entity) ([]byte, error)
+	Unmarshal(e *Entity, b []byte) error
+}
+
+// errStaleCodec is returned by a Codec's Unmarshal when the value's version
+// tag doesn't match, meaning it was written by a different codec. GetMulti
+// treats this as a cache miss rather than surfacing it as a decode error.
+var errStaleCodec = errors.New("goon: memcache value encoded by a different codec")
+
+const (
+	codecVersionGob          byte = 1
+	codecVersionPropertyList byte = 2
+)
+
+// cacheMarkerNotFound marks a negative cache entry (an entity known not to
+// exist in datastore), in place of whatever a Codec would otherwise
+// produce. It must never collide with a codecVersion* value, since every
+// Codec already prefixes its own output with one of those as its first
+// byte; 0xff is reserved for this purpose and is not a valid codec version.
+const cacheMarkerNotFound byte = 0xff
+
+// encodeCacheValue builds the memcache value for e. A NotFound entity is
+// encoded as a bare marker byte, since there are no properties to save. A
+// found entity is encoded as whatever the Codec produces, unprefixed, so
+// existing memcache values from before negative caching was introduced
+// remain readable.
+func encodeCacheValue(c Codec, e *Entity) ([]byte, error) {
+	if e.NotFound {
+		return []byte{cacheMarkerNotFound}, nil
+	}
+
+	return c.Marshal(e)
+}
+
+// decodeCacheValue is the inverse of encodeCacheValue. It returns
+// errStaleCodec if b is empty, if e has no Src to decode a found entity
+// into, or if the Codec rejects b's version tag, so the caller can treat it
+// as a cache miss rather than a decode error. Any other error from the
+// Codec's Unmarshal is returned as is.
+func decodeCacheValue(c Codec, e *Entity, b []byte) error {
+	if len(b) == 0 {
+		return errStaleCodec
+	}
+	if b[0] == cacheMarkerNotFound {
+		e.NotFound = true
+		return nil
+	}
+	if e.Src == nil {
+		// No concrete type to decode into, as with a keys-only query's
+		// Iterator/GetAll. Treat it as a miss so the caller falls back
+		// to resolving the key against datastore instead.
+		return errStaleCodec
+	}
+	return c.Unmarshal(e, b)
+}
+
+// GobCodec is the default Codec. It gob-encodes the Entity itself, which
+// requires gob.Register-ing every distinct struct type on each decode.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(e *Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(codecVersionGob)
+	gob.Register(e.Src)
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(e *Entity, b []byte) error {
+	if len(b) == 0 || b[0] != codecVersionGob {
+		return errStaleCodec
+	}
+	buf := bytes.NewBuffer(b[1:])
+	gob.Register(e.Src)
+	return gob.NewDecoder(buf).Decode(e)
+}
+
+// PropertyListCodec serializes an Entity's datastore.PropertyList instead of
+// the Go struct itself, via datastore.SaveStruct/LoadStruct. This makes
+// memcache values portable across Go binaries and independent of struct
+// field reordering, and avoids gob.Register-ing every entity's type.
+type PropertyListCodec struct{}
+
+func (PropertyListCodec) Marshal(e *Entity) ([]byte, error) {
+	pl, err := saveProperties(e.Src)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(codecVersionPropertyList)
+	if err := gob.NewEncoder(&buf).Encode(pl); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (PropertyListCodec) Unmarshal(e *Entity, b []byte) error {
+	if len(b) == 0 || b[0] != codecVersionPropertyList {
+		return errStaleCodec
+	}
+
+	var pl datastore.PropertyList
+	buf := bytes.NewBuffer(b[1:])
+	if err := gob.NewDecoder(buf).Decode(&pl); err != nil {
+		return err
+	}
+
+	return loadProperties(e.Src, pl)
+}
+
+// saveProperties drains src's properties, as datastore.SaveStruct would
+// write them to datastore, into a PropertyList.
+func saveProperties(src interface{}) (datastore.PropertyList, error) {
+	c := make(chan datastore.Property, 16)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- datastore.SaveStruct(src, c)
+		close(c)
+	}()
+
+	var pl datastore.PropertyList
+	for p := range c {
+		pl = append(pl, p)
+	}
+
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// loadProperties replays pl into dst, as datastore.LoadStruct would when
+// loading an entity fetched from datastore.
+func loadProperties(dst interface{}, pl datastore.PropertyList) error {
+	c := make(chan datastore.Property, len(pl))
+	for _, p := range pl {
+		c <- p
+	}
+	close(c)
+
+	return datastore.LoadStruct(dst, c)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"reflect"
+	"testing"
+)
+
+type codecTestEntity struct {
+	Name string
+}
+
+func allCodecs() map[string]Codec {
+	return map[string]Codec{
+		"GobCodec":          GobCodec{},
+		"PropertyListCodec": PropertyListCodec{},
+	}
+}
+
+func TestCodecMarshalUnmarshalRoundTrip(t *testing.T) {
+	for name, c := range allCodecs() {
+		t.Run(name, func(t *testing.T) {
+			src := &codecTestEntity{Name: "alice"}
+			e := &Entity{Src: src}
+
+			b, err := c.Marshal(e)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+
+			got := &Entity{Src: &codecTestEntity{}}
+			if err := c.Unmarshal(got, b); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got.Src, src) {
+				t.Fatalf("Unmarshal produced %+v, want %+v", got.Src, src)
+			}
+		})
+	}
+}
+
+func TestCodecUnmarshalRejectsOtherCodecsVersion(t *testing.T) {
+	src := &codecTestEntity{Name: "alice"}
+
+	gobBytes, err := (GobCodec{}).Marshal(&Entity{Src: src})
+	if err != nil {
+		t.Fatalf("GobCodec.Marshal: %v", err)
+	}
+	plBytes, err := (PropertyListCodec{}).Marshal(&Entity{Src: src})
+	if err != nil {
+		t.Fatalf("PropertyListCodec.Marshal: %v", err)
+	}
+
+	if err := (PropertyListCodec{}).Unmarshal(&Entity{Src: &codecTestEntity{}}, gobBytes); err != errStaleCodec {
+		t.Errorf("PropertyListCodec.Unmarshal(gob bytes) = %v, want errStaleCodec", err)
+	}
+	if err := (GobCodec{}).Unmarshal(&Entity{Src: &codecTestEntity{}}, plBytes); err != errStaleCodec {
+		t.Errorf("GobCodec.Unmarshal(property list bytes) = %v, want errStaleCodec", err)
+	}
+}
+
+func TestCodecUnmarshalEmptyValueIsStale(t *testing.T) {
+	for name, c := range allCodecs() {
+		t.Run(name, func(t *testing.T) {
+			if err := c.Unmarshal(&Entity{Src: &codecTestEntity{}}, nil); err != errStaleCodec {
+				t.Errorf("Unmarshal(nil) = %v, want errStaleCodec", err)
+			}
+		})
+	}
+}
+
+// TestCodecVersionsAreDistinct guards against two Codecs sharing a version
+// byte, which would make GetMulti misinterpret one codec's values as the
+// other's.
+func TestCodecVersionsAreDistinct(t *testing.T) {
+	if codecVersionGob == codecVersionPropertyList {
+		t.Fatalf("codecVersionGob and codecVersionPropertyList must differ")
+	}
+}
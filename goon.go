@@ -20,20 +20,29 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
-	"bytes"
-	"encoding/gob"
 	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+	"time"
 )
 
+// defaultNotFoundExpiration is how long a negative cache entry (an entity
+// that didn't exist in datastore) is kept in memcache by default. It is
+// kept short relative to normal entries so a key that later comes into
+// existence isn't shadowed for long, while still shielding datastore from
+// a dogpile of repeated Get calls for a missing key.
+const defaultNotFoundExpiration = 5 * time.Second
+
 // Goon holds the app engine context and request memory cache.
 type Goon struct {
-	context       appengine.Context
-	cache         map[string]*Entity
-	inTransaction bool
-	toSet         map[string]*Entity
-	toDelete      map[string]*Entity
+	context            appengine.Context
+	cache              map[string]*Entity
+	inTransaction      bool
+	toSet              map[string]*Entity
+	toDelete           map[string]*Entity
+	codec              Codec
+	notFoundExpiration time.Duration
 }
 
 func memkey(k *datastore.Key) string {
@@ -42,37 +51,72 @@ func memkey(k *datastore.Key) string {
 
 func NewGoon(r *http.Request) *Goon {
 	return &Goon{
-		context: appengine.NewContext(r),
-		cache:   make(map[string]*Entity),
+		context:            appengine.NewContext(r),
+		cache:              make(map[string]*Entity),
+		codec:              GobCodec{},
+		notFoundExpiration: defaultNotFoundExpiration,
 	}
 }
 
+// SetCodec overrides the Codec used to (de)serialize entities for memcache.
+// The default is GobCodec.
+func (g *Goon) SetCodec(c Codec) {
+	g.codec = c
+}
+
+// SetNotFoundExpiration overrides how long a negative cache entry for a
+// missing entity is kept in memcache. The default is 5 seconds.
+func (g *Goon) SetNotFoundExpiration(d time.Duration) {
+	g.notFoundExpiration = d
+}
+
 // RunInTransaction runs f in a transaction. It calls f with a transaction
 // context g that f should use for all App Engine operations. Neither cache nor
-// memcache are used or set during a transaction.
+// memcache are used or set during a transaction; the outer Goon's cache is
+// only updated once the transaction commits.
+//
+// If opts.Attempts is greater than 1, f is retried on
+// datastore.ErrConcurrentTransaction, sleeping between attempts according to
+// opts.Backoff. Cache mutations from failed attempts are discarded; only the
+// attempt that commits is merged into g's cache.
 //
 // Otherwise similar to appengine/datastore.RunInTransaction:
 // https://developers.google.com/appengine/docs/go/datastore/reference#RunInTransaction
-func (g *Goon) RunInTransaction(f func(g *Goon) error, opts *datastore.TransactionOptions) error {
-	var ng *Goon
-	err := datastore.RunInTransaction(g.context, func(tc appengine.Context) error {
-		ng = &Goon{
-			context:       tc,
-			inTransaction: true,
-			toSet:         make(map[string]*Entity),
-			toDelete:      make(map[string]*Entity),
-		}
-		return f(ng)
-	}, opts)
+func (g *Goon) RunInTransaction(f func(g *Goon) error, opts *TxOptions) error {
+	dsOpts, attempts, backoff := resolveTxOptions(opts)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var ng *Goon
+		err = datastore.RunInTransaction(g.context, func(tc appengine.Context) error {
+			ng = &Goon{
+				context:            tc,
+				inTransaction:      true,
+				toSet:              make(map[string]*Entity),
+				toDelete:           make(map[string]*Entity),
+				codec:              g.codec,
+				notFoundExpiration: g.notFoundExpiration,
+			}
+			return f(ng)
+		}, dsOpts)
+
+		if err == nil {
+			for k, v := range ng.toSet {
+				g.cache[k] = v
+			}
+
+			for k := range ng.toDelete {
+				delete(g.cache, k)
+			}
 
-	if err == nil {
-		for k, v := range ng.toSet {
-			g.cache[k] = v
+			return nil
 		}
 
-		for k := range ng.toDelete {
-			delete(g.cache, k)
+		if err != datastore.ErrConcurrentTransaction || attempt == attempts {
+			return err
 		}
+
+		time.Sleep(backoff(attempt))
 	}
 
 	return err
@@ -125,6 +169,51 @@ func (g *Goon) PutMulti(es []*Entity) error {
 	return nil
 }
 
+// Delete deletes the entity for the given key.
+func (g *Goon) Delete(key *datastore.Key) error {
+	return g.DeleteMulti([]*datastore.Key{key})
+}
+
+// KeyDelete deletes the entity of kind src stored under key. It returns an
+// error without deleting anything if key's kind doesn't match src's.
+func (g *Goon) KeyDelete(src interface{}, key *datastore.Key) error {
+	k, err := structKind(src)
+	if err != nil {
+		return err
+	}
+	if k != key.Kind() {
+		return fmt.Errorf("goon: key kind %q does not match kind %q of src", key.Kind(), k)
+	}
+	return g.Delete(key)
+}
+
+// DeleteMulti deletes the entities for the given keys.
+func (g *Goon) DeleteMulti(keys []*datastore.Key) error {
+	memkeys := make([]string, len(keys))
+	for i, k := range keys {
+		memkeys[i] = memkey(k)
+	}
+
+	err := datastore.DeleteMulti(g.context, keys)
+	if err != nil {
+		return err
+	}
+
+	memcache.DeleteMulti(g.context, memkeys)
+
+	if g.inTransaction {
+		for i, k := range keys {
+			g.toDelete[memkeys[i]] = &Entity{Key: k}
+		}
+	} else {
+		for _, m := range memkeys {
+			delete(g.cache, m)
+		}
+	}
+
+	return nil
+}
+
 func (g *Goon) putMemoryMulti(es []*Entity) {
 	for _, e := range es {
 		g.putMemory(e)
@@ -136,51 +225,75 @@ func (g *Goon) putMemory(e *Entity) {
 }
 
 func (g *Goon) putMemcache(es []*Entity) error {
-	items := make([]*memcache.Item, len(es))
+	var items []*memcache.Item
+	var cacheable []*Entity
 
-	for i, e := range es {
-		gob, err := e.gob()
+	for _, e := range es {
+		if e.Src == nil && !e.NotFound {
+			// No concrete type to encode, as with a keys-only query's
+			// Iterator/GetAll whose key had to be resolved against
+			// datastore. There's nothing to cache.
+			continue
+		}
+
+		b, err := encodeCacheValue(g.codec, e)
 		if err != nil {
 			return err
 		}
 
-		items[i] = &memcache.Item{
+		item := &memcache.Item{
 			Key:   e.memkey(),
-			Value: gob,
+			Value: b,
+		}
+		if e.NotFound {
+			item.Expiration = g.notFoundExpiration
 		}
+		items = append(items, item)
+		cacheable = append(cacheable, e)
 	}
 
-	err := memcache.SetMulti(g.context, items)
+	if len(items) == 0 {
+		return nil
+	}
 
-	if err != nil {
+	if err := memcache.SetMulti(g.context, items); err != nil {
 		return err
 	}
 
-	g.putMemoryMulti(es)
+	g.putMemoryMulti(cacheable)
 	return nil
 }
 
-// structKind returns the reflect.Kind name of src if it is a struct, else nil.
+// structKind returns the datastore kind for src. If src's type was
+// registered with Register and given an explicit kind via WithKind, that
+// kind is used; otherwise it falls back to reflect.Type.Name().
 func structKind(src interface{}) (string, error) {
 	v := reflect.ValueOf(src)
 	v = reflect.Indirect(v)
 	t := v.Type()
 	k := t.Kind()
 
-	if k == reflect.Struct {
-		return t.Name(), nil
+	if k != reflect.Struct {
+		return "", errors.New("goon: src has invalid type")
 	}
-	return "", errors.New("goon: src has invalid type")
+
+	if spec, ok := kindSpecOf(t); ok && spec.kind != "" {
+		return spec.kind, nil
+	}
+
+	return t.Name(), nil
 }
 
-// Get fetches an entity of kind src by.
-// Refer to appengine/datastore.NewKey regarding key specification.
-func (g *Goon) Get(src interface{}, stringID string, intID int64, parent *datastore.Key) (*Entity, error) {
-	k, err := structKind(src)
+// Get fetches the entity of kind src whose key is derived from src's type
+// registration: the kind and parent come from Register/WithKind/WithParent,
+// and the ID comes from the field tagged `goon:"id"`. For example, after
+// goon.Register(&User{}), g.Get(&User{Email: "x"}) fetches the User keyed
+// by its Email field. To fetch by an explicit key instead, use KeyGet.
+func (g *Goon) Get(src interface{}) (*Entity, error) {
+	key, err := g.structKey(src)
 	if err != nil {
 		return nil, err
 	}
-	key := datastore.NewKey(g.context, k, stringID, intID, parent)
 	return g.KeyGet(src, key)
 }
 
@@ -195,6 +308,34 @@ func (g *Goon) KeyGet(src interface{}, key *datastore.Key) (*Entity, error) {
 	return es[0], nil
 }
 
+// noopPropertyLoadSaver discards whatever properties datastore.GetMulti
+// would otherwise load into it. It stands in for an Entity's Src when Src
+// is nil, which happens for a keys-only query result (see Iterator.Next
+// and GetAll in iterator.go): the key's concrete Go type isn't known, so
+// there's nothing to decode into, but datastore.GetMulti still needs a
+// non-nil destination to confirm the key exists.
+type noopPropertyLoadSaver struct{}
+
+func (noopPropertyLoadSaver) Load(c <-chan datastore.Property) error {
+	for range c {
+	}
+	return nil
+}
+
+func (noopPropertyLoadSaver) Save(c chan<- datastore.Property) error {
+	close(c)
+	return nil
+}
+
+// dstFor returns the datastore.GetMulti destination for e: e.Src itself,
+// or a noopPropertyLoadSaver if e.Src is nil.
+func dstFor(e *Entity) interface{} {
+	if e.Src == nil {
+		return noopPropertyLoadSaver{}
+	}
+	return e.Src
+}
+
 // Get fetches a sequency of Entities, whose keys must already be valid.
 // Entities with no correspending key have their NotFound field set to true.
 func (g *Goon) GetMulti(es []*Entity) error {
@@ -223,18 +364,24 @@ func (g *Goon) GetMulti(es []*Entity) error {
 
 		for i, m := range memkeys {
 			e := es[mixs[i]]
-			if s, present := memvalues[m]; present {
-				err := fromGob(e, s.Value)
-				if err != nil {
+			s, present := memvalues[m]
+			if present {
+				err := decodeCacheValue(g.codec, e, s.Value)
+				if err == nil {
+					g.putMemory(e)
+					continue
+				}
+				if err != errStaleCodec {
 					return err
 				}
-
-				g.putMemory(e)
-			} else {
-				dskeys = append(dskeys, e.Key)
-				dst = append(dst, e.Src)
-				dixs = append(dixs, mixs[i])
+				// Value is empty, was written by a different codec, or
+				// e has no Src to decode into (a keys-only query);
+				// treat it like a miss instead of surfacing an error.
 			}
+
+			dskeys = append(dskeys, e.Key)
+			dst = append(dst, dstFor(e))
+			dixs = append(dixs, mixs[i])
 		}
 	} else {
 		dskeys = make([]*datastore.Key, len(es))
@@ -243,7 +390,7 @@ func (g *Goon) GetMulti(es []*Entity) error {
 
 		for i, e := range es {
 			dskeys[i] = e.Key
-			dst[i] = e.Src
+			dst[i] = dstFor(e)
 			dixs[i] = i
 		}
 	}
@@ -284,11 +431,3 @@ func (g *Goon) GetMulti(es []*Entity) error {
 
 	return nil
 }
-
-func fromGob(e *Entity, b []byte) error {
-	var buf bytes.Buffer
-	_, _ = buf.Write(b)
-	gob.Register(e.Src)
-	dec := gob.NewDecoder(&buf)
-	return dec.Decode(e)
-}
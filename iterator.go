@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"appengine/datastore"
+	"reflect"
+)
+
+// Iterator runs a datastore query and hydrates the results through the
+// same cache layers used by Get and GetMulti.
+type Iterator struct {
+	g  *Goon
+	q  *datastore.Query
+	it *datastore.Iterator
+}
+
+// Run runs the given query against datastore, returning an Iterator over
+// the results.
+func (g *Goon) Run(q *datastore.Query) *Iterator {
+	return &Iterator{
+		g:  g,
+		q:  q,
+		it: q.Run(g.context),
+	}
+}
+
+// Next returns the entity for the next query result. If dst is non-nil,
+// it is used as the destination for the entity's properties, and the
+// result is cached through memcache and the local cache, mirroring
+// GetMulti. If dst is nil (a keys-only query), the key is resolved
+// through the cache layers and a GetMulti fallback. It returns
+// datastore.Done when the iteration is complete.
+func (it *Iterator) Next(dst interface{}) (*Entity, error) {
+	k, err := it.it.Next(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if dst == nil {
+		es := []*Entity{{Key: k}}
+		if err := it.g.GetMulti(es); err != nil {
+			return nil, err
+		}
+		return es[0], nil
+	}
+
+	e := NewEntity(k, dst)
+	if !it.g.inTransaction {
+		if err := it.g.putMemcache([]*Entity{e}); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Cursor returns a cursor for the iterator's current position.
+func (it *Iterator) Cursor() (datastore.Cursor, error) {
+	return it.it.Cursor()
+}
+
+// Seek resumes iteration from the given cursor.
+func (it *Iterator) Seek(c datastore.Cursor) error {
+	it.q = it.q.Start(c)
+	it.it = it.q.Run(it.g.context)
+	return nil
+}
+
+// GetAll runs the query and returns all of its entities, hydrated as
+// *Entity. For keys-only queries (dst is nil), each key is resolved
+// through the local cache and memcache before falling back to a
+// GetMulti against datastore. Otherwise, the results populate dst as
+// datastore.GetAll does, and are cached as a side effect, like GetMulti.
+func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*Entity, error) {
+	keys, err := datastore.GetAll(g.context, q, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if dst == nil {
+		es := make([]*Entity, len(keys))
+		for i, k := range keys {
+			es[i] = &Entity{Key: k}
+		}
+		if err := g.GetMulti(es); err != nil {
+			return nil, err
+		}
+		return es, nil
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	es := make([]*Entity, len(keys))
+	for i, k := range keys {
+		es[i] = NewEntity(k, v.Index(i).Addr().Interface())
+	}
+
+	if !g.inTransaction {
+		if err := g.putMemcache(es); err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
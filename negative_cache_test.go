@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import "testing"
+
+func TestEncodeDecodeCacheValue_Found(t *testing.T) {
+	for name, c := range allCodecs() {
+		t.Run(name, func(t *testing.T) {
+			e := &Entity{Src: &codecTestEntity{Name: "alice"}}
+
+			b, err := encodeCacheValue(c, e)
+			if err != nil {
+				t.Fatalf("encodeCacheValue: %v", err)
+			}
+			if len(b) == 0 || b[0] == cacheMarkerNotFound {
+				t.Fatalf("found entity encoded starting with the not-found marker: %v", b)
+			}
+
+			got := &Entity{Src: &codecTestEntity{}}
+			if err := decodeCacheValue(c, got, b); err != nil {
+				t.Fatalf("decodeCacheValue: %v", err)
+			}
+			if got.NotFound {
+				t.Fatalf("found entity decoded with NotFound set")
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeCacheValue_NotFound(t *testing.T) {
+	for name, c := range allCodecs() {
+		t.Run(name, func(t *testing.T) {
+			b, err := encodeCacheValue(c, &Entity{NotFound: true})
+			if err != nil {
+				t.Fatalf("encodeCacheValue: %v", err)
+			}
+			if len(b) != 1 || b[0] != cacheMarkerNotFound {
+				t.Fatalf("NotFound entity encoded as %v, want a single cacheMarkerNotFound byte", b)
+			}
+
+			got := &Entity{}
+			if err := decodeCacheValue(c, got, b); err != nil {
+				t.Fatalf("decodeCacheValue: %v", err)
+			}
+			if !got.NotFound {
+				t.Fatalf("decoded entity should have NotFound set")
+			}
+		})
+	}
+}
+
+// TestCacheMarkerNotFoundDoesNotCollideWithCodecVersions guards against
+// the regression where cacheMarkerNotFound and codecVersionGob were both
+// 1, which made every pre-existing GobCodec-encoded "found" value decode
+// as a negative cache entry.
+func TestCacheMarkerNotFoundDoesNotCollideWithCodecVersions(t *testing.T) {
+	for _, v := range []byte{codecVersionGob, codecVersionPropertyList} {
+		if v == cacheMarkerNotFound {
+			t.Fatalf("codec version %d collides with cacheMarkerNotFound", v)
+		}
+	}
+}
+
+func TestDecodeCacheValue_UnreadableIsCacheMiss(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"unknown version byte", []byte{0x42, 'x', 'y'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Entity{Src: &codecTestEntity{}}
+			if err := decodeCacheValue(GobCodec{}, e, tt.b); err != errStaleCodec {
+				t.Fatalf("decodeCacheValue = %v, want errStaleCodec", err)
+			}
+		})
+	}
+}
+
+// TestDecodeCacheValue_NilSrcIsCacheMiss covers the keys-only query case
+// (Iterator.Next/GetAll with a nil dst): the concrete Go type behind a key
+// isn't known, so even a valid, found-entity memcache value can't be
+// decoded, and decodeCacheValue must report a miss rather than erroring or
+// panicking.
+func TestDecodeCacheValue_NilSrcIsCacheMiss(t *testing.T) {
+	b, err := encodeCacheValue(GobCodec{}, &Entity{Src: &codecTestEntity{Name: "bob"}})
+	if err != nil {
+		t.Fatalf("encodeCacheValue: %v", err)
+	}
+
+	e := &Entity{}
+	if err := decodeCacheValue(GobCodec{}, e, b); err != errStaleCodec {
+		t.Fatalf("decodeCacheValue = %v, want errStaleCodec for an entity with nil Src", err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"appengine/datastore"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// kindSpec holds the kind metadata registered for a struct type via Register.
+type kindSpec struct {
+	kind    string
+	parent  func(src interface{}) *datastore.Key
+	idField string
+}
+
+var (
+	kindsMu sync.RWMutex
+	kinds   = make(map[reflect.Type]*kindSpec)
+)
+
+// KindOption configures a type's registration. See Register.
+type KindOption func(*kindSpec)
+
+// WithKind overrides the datastore kind name used for the registered type.
+// Without it, the kind defaults to the struct's reflect.Type.Name().
+func WithKind(kind string) KindOption {
+	return func(s *kindSpec) {
+		s.kind = kind
+	}
+}
+
+// WithParent sets a function that resolves the parent key for an instance
+// of the registered type.
+func WithParent(f func(src interface{}) *datastore.Key) KindOption {
+	return func(s *kindSpec) {
+		s.parent = f
+	}
+}
+
+// Register associates src's type with a datastore kind, an optional parent
+// key resolver, and an ID field, so that Get can derive a key from src
+// instead of the caller passing stringID/intID/parent by hand. The ID field
+// is taken from the struct field tagged `goon:"id"`, analogous to how
+// cloud.google.com/go/datastore uses `datastore:"..."` tags. The field must
+// be a string (for a string ID) or a signed integer type (for an int64 ID);
+// unsigned integer fields are not supported.
+func Register(src interface{}, opts ...KindOption) error {
+	t := reflect.Indirect(reflect.ValueOf(src)).Type()
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("goon: src has invalid type")
+	}
+
+	spec := &kindSpec{kind: t.Name()}
+	for _, opt := range opts {
+		opt(spec)
+	}
+
+	if spec.idField == "" {
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("goon") == "id" {
+				spec.idField = t.Field(i).Name
+				break
+			}
+		}
+	}
+
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	kinds[t] = spec
+
+	return nil
+}
+
+// kindSpecOf returns the registered kindSpec for t, if any.
+func kindSpecOf(t reflect.Type) (*kindSpec, bool) {
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	spec, ok := kinds[t]
+	return spec, ok
+}
+
+// structKey derives the datastore key for src from its registered kind,
+// parent resolver, and `goon:"id"` field.
+func (g *Goon) structKey(src interface{}) (*datastore.Key, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	t := v.Type()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("goon: src has invalid type")
+	}
+
+	kind, err := structKind(src)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, ok := kindSpecOf(t)
+	if !ok || spec.idField == "" {
+		return nil, fmt.Errorf("goon: %s has no registered id field; use KeyGet instead", t.Name())
+	}
+
+	var parent *datastore.Key
+	if spec.parent != nil {
+		parent = spec.parent(src)
+	}
+
+	var stringID string
+	var intID int64
+
+	f := v.FieldByName(spec.idField)
+	switch f.Kind() {
+	case reflect.String:
+		stringID = f.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		intID = f.Int()
+	default:
+		return nil, fmt.Errorf("goon: id field %q of %s has unsupported type %s", spec.idField, t.Name(), f.Kind())
+	}
+
+	return datastore.NewKey(g.context, kind, stringID, intID, parent), nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"appengine/datastore"
+	"math/rand"
+	"time"
+)
+
+// defaultBackoffBase is the starting point for the default exponential
+// backoff: attempt 1 waits ~100ms, attempt 2 ~200ms, and so on, each with
+// up to defaultBackoffBase of jitter added to avoid a thundering herd of
+// retries landing on the same entity group together.
+const defaultBackoffBase = 100 * time.Millisecond
+
+// TxOptions configures RunInTransaction, extending the underlying
+// datastore transaction options with cross-group support and client-side
+// retry behavior.
+//
+// TxOptions.Attempts is the only retry knob RunInTransaction honors, even
+// though the embedded *datastore.TransactionOptions has its own same-named
+// Attempts field. A cross-group transaction is used if XG is set on either
+// TxOptions or the embedded options. RunInTransaction clears
+// TransactionOptions.Attempts before calling
+// datastore.RunInTransaction, so this package's retry loop is always the
+// sole source of attempt-based retries and the two can't silently compound.
+type TxOptions struct {
+	*datastore.TransactionOptions
+
+	// Attempts is how many times to run f. A value less than 1 is treated
+	// as 1, i.e. no retries.
+	Attempts int
+
+	// XG allows the transaction to span up to 5 entity groups.
+	XG bool
+
+	// Backoff computes how long to sleep before retry attempt n (n is
+	// 1 for the delay before the 2nd attempt, 2 before the 3rd, etc).
+	// Defaults to exponential backoff from 100ms with jitter.
+	Backoff func(attempt int) time.Duration
+}
+
+// defaultBackoff is the Backoff used when TxOptions.Backoff is nil.
+func defaultBackoff(attempt int) time.Duration {
+	d := defaultBackoffBase << uint(attempt-1)
+	return d + time.Duration(rand.Int63n(int64(defaultBackoffBase)))
+}
+
+// resolveTxOptions reconciles opts (which may be nil) into the
+// *datastore.TransactionOptions to forward to datastore.RunInTransaction,
+// the number of attempts, and the backoff to use between them. It copies
+// rather than mutates opts.TransactionOptions, since callers may share
+// that pointer across multiple TxOptions values, and it always zeroes the
+// copy's Attempts field so RunInTransaction's own retry loop is the only
+// thing retrying.
+func resolveTxOptions(opts *TxOptions) (dsOpts *datastore.TransactionOptions, attempts int, backoff func(int) time.Duration) {
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+
+	backoff = opts.Backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+
+	var local datastore.TransactionOptions
+	if opts.TransactionOptions != nil {
+		local = *opts.TransactionOptions
+	}
+	local.XG = local.XG || opts.XG
+	local.Attempts = 0
+
+	attempts = opts.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	return &local, attempts, backoff
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"appengine/datastore"
+	"testing"
+	"time"
+)
+
+func TestResolveTxOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         *TxOptions
+		wantXG       bool
+		wantAttempts int
+	}{
+		{
+			name:         "nil opts",
+			opts:         nil,
+			wantXG:       false,
+			wantAttempts: 1,
+		},
+		{
+			name:         "XG requested via TxOptions",
+			opts:         &TxOptions{XG: true},
+			wantXG:       true,
+			wantAttempts: 1,
+		},
+		{
+			name: "XG already set on embedded options",
+			opts: &TxOptions{
+				TransactionOptions: &datastore.TransactionOptions{XG: true},
+			},
+			wantXG:       true,
+			wantAttempts: 1,
+		},
+		{
+			name:         "Attempts less than 1 is clamped to 1",
+			opts:         &TxOptions{Attempts: 0},
+			wantXG:       false,
+			wantAttempts: 1,
+		},
+		{
+			name:         "Attempts is honored",
+			opts:         &TxOptions{Attempts: 5},
+			wantXG:       false,
+			wantAttempts: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsOpts, attempts, backoff := resolveTxOptions(tt.opts)
+
+			if dsOpts == nil {
+				t.Fatal("resolveTxOptions returned nil dsOpts")
+			}
+			if dsOpts.XG != tt.wantXG {
+				t.Errorf("XG = %v, want %v", dsOpts.XG, tt.wantXG)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if backoff == nil {
+				t.Error("backoff is nil")
+			}
+		})
+	}
+}
+
+// TestResolveTxOptionsZeroesEmbeddedAttempts ensures the SDK's own
+// TransactionOptions.Attempts never reaches datastore.RunInTransaction, so
+// it can't silently compound with this package's retry loop.
+func TestResolveTxOptionsZeroesEmbeddedAttempts(t *testing.T) {
+	opts := &TxOptions{
+		TransactionOptions: &datastore.TransactionOptions{Attempts: 3},
+		Attempts:           5,
+	}
+
+	dsOpts, attempts, _ := resolveTxOptions(opts)
+
+	if dsOpts.Attempts != 0 {
+		t.Errorf("dsOpts.Attempts = %d, want 0", dsOpts.Attempts)
+	}
+	if attempts != 5 {
+		t.Errorf("attempts = %d, want 5", attempts)
+	}
+}
+
+// TestResolveTxOptionsDoesNotMutateCaller ensures a shared
+// *datastore.TransactionOptions isn't mutated in place, since callers may
+// reuse it across multiple TxOptions values.
+func TestResolveTxOptionsDoesNotMutateCaller(t *testing.T) {
+	shared := &datastore.TransactionOptions{}
+
+	resolveTxOptions(&TxOptions{TransactionOptions: shared, XG: true})
+	if shared.XG {
+		t.Fatal("resolveTxOptions mutated the caller's shared TransactionOptions")
+	}
+
+	dsOpts, _, _ := resolveTxOptions(&TxOptions{TransactionOptions: shared, XG: false})
+	if dsOpts.XG {
+		t.Fatal("a later, unrelated call picked up XG from the previously shared pointer")
+	}
+}
+
+func TestResolveTxOptionsCustomBackoff(t *testing.T) {
+	want := 42 * time.Second
+	custom := func(attempt int) time.Duration { return want }
+
+	_, _, backoff := resolveTxOptions(&TxOptions{Backoff: custom})
+
+	if got := backoff(1); got != want {
+		t.Errorf("backoff(1) = %v, want %v", got, want)
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 4; attempt++ {
+		d := defaultBackoff(attempt)
+		min := defaultBackoffBase << uint(attempt-1)
+		max := min + defaultBackoffBase
+
+		if d < min || d >= max {
+			t.Errorf("defaultBackoff(%d) = %v, want in [%v, %v)", attempt, d, min, max)
+		}
+	}
+}